@@ -0,0 +1,607 @@
+// Package rehttp provides an http.RoundTripper that can retry failed
+// requests according to a set of rules.
+package rehttp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DelayFn is a function that returns the delay to respect before the
+// next retry attempt. It is called with the request, the response
+// (which may be nil if err is not nil), the attempt number (starting
+// at 0 for the first retry) and the error from the failed attempt (if
+// any).
+type DelayFn func(req *http.Request, res *http.Response, attempt int, err error) time.Duration
+
+// RetryFn is a function that determines if a request should be
+// retried. It is called with the same arguments as DelayFn, and
+// returns true if the request should be retried.
+type RetryFn func(req *http.Request, res *http.Response, attempt int, err error) bool
+
+// Transport is an http.RoundTripper that wraps another RoundTripper
+// (or http.DefaultTransport if none is provided) and retries requests
+// based on retryFn, waiting delayFn between each attempt.
+type Transport struct {
+	rt      http.RoundTripper
+	retryFn RetryFn
+	delayFn DelayFn
+
+	// PreventRetryWithBody prevents retrying a request that has a body.
+	// By default, the transport reads and buffers the whole body on the
+	// first attempt so it can be replayed on retries; setting this field
+	// to true avoids buffering the body at all, at the cost of never
+	// retrying requests that have one.
+	PreventRetryWithBody bool
+
+	// BodyBufferLimit caps how many bytes of a request body are kept in
+	// memory for replay across retries. Bodies at or under the limit
+	// are buffered in memory, as with the zero value. Bodies larger
+	// than the limit are spilled to a temp file instead, which is
+	// re-opened on each retry and removed once RoundTrip returns. A
+	// negative value disables buffering entirely: the body is streamed
+	// through unmodified and the request is never retried, the same as
+	// setting PreventRetryWithBody.
+	BodyBufferLimit int64
+
+	// Trace, if set, is notified of retry decisions made while
+	// executing a request. See RetryTrace for details.
+	Trace *RetryTrace
+
+	budgetOnce   sync.Once
+	budgetWindow *retryBudgetWindow
+}
+
+// RetryTrace holds optional callbacks that a Transport invokes at
+// points of interest during its retry loop, in the same spirit as
+// net/http/httptrace's hooks for connection events. Callbacks left nil
+// are simply not invoked, and all of them must be safe to call
+// concurrently if the Transport is shared across goroutines.
+type RetryTrace struct {
+	// WillRetry is called after a failed attempt for which retryFn
+	// decided to retry, right before the Transport waits delay and
+	// re-sends the request.
+	WillRetry func(req *http.Request, res *http.Response, attempt int, err error, delay time.Duration)
+
+	// GaveUp is called once, right before RoundTrip returns a failed
+	// result, if retryFn asked for at least one retry beforehand; this
+	// includes the request's context being done while waiting out a
+	// retry delay, even before the retry was sent. It is not
+	// called when a retried request eventually succeeds. attempts is
+	// the total number of attempts made, including the first one.
+	GaveUp func(req *http.Request, res *http.Response, attempts int, err error)
+}
+
+// isFailure reports whether res/err represents an unsuccessful outcome,
+// for the purposes of deciding whether RetryTrace.GaveUp should fire:
+// an error, a missing response, or a 4xx/5xx status code. retryFn may
+// use a finer-grained notion of failure, but it only reports whether to
+// retry, not why, so this is the best classification available here.
+func isFailure(res *http.Response, err error) bool {
+	return err != nil || res == nil || res.StatusCode >= 400
+}
+
+// NewTransport creates a Transport that uses rt to execute requests, or
+// http.DefaultTransport if rt is nil. It retries failed requests as
+// determined by retryFn, waiting the duration returned by delayFn
+// between each attempt. The wait between attempts is interruptible: if
+// req.Context() is done before the delay elapses, RoundTrip returns
+// immediately with the context's error, just as net/http does when a
+// request is canceled mid-flight.
+func NewTransport(rt http.RoundTripper, retryFn RetryFn, delayFn DelayFn) *Transport {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return &Transport{rt: rt, retryFn: retryFn, delayFn: delayFn}
+}
+
+// CancelRequest cancels an in-flight request by calling the underlying
+// RoundTripper's CancelRequest method, if it implements the legacy
+// canceler interface.
+func (t *Transport) CancelRequest(req *http.Request) {
+	type canceler interface {
+		CancelRequest(*http.Request)
+	}
+	if cr, ok := t.rt.(canceler); ok {
+		cr.CancelRequest(req)
+	}
+}
+
+// budgetWindowOrInit returns the Transport's retry budget window,
+// creating it on first use.
+func (t *Transport) budgetWindowOrInit() *retryBudgetWindow {
+	t.budgetOnce.Do(func() { t.budgetWindow = &retryBudgetWindow{} })
+	return t.budgetWindow
+}
+
+// RetryBudgetStats returns the total number of requests and retries
+// recorded over the Transport's current 30 second sliding window, as
+// tracked by a retryFn built with RetryBudget. If the Transport's
+// retryFn was not built with RetryBudget, it always returns (0, 0).
+func (t *Transport) RetryBudgetStats() (retries, requests int) {
+	return t.budgetWindowOrInit().stats()
+}
+
+// prepareBody arranges for req's body, if any, to be replayable across
+// retry attempts, honoring PreventRetryWithBody and BodyBufferLimit. It
+// returns a cleanup func that must be deferred by the caller to remove
+// any temp file created, and whether the request may be retried at
+// all.
+func (t *Transport) prepareBody(req *http.Request) (cleanup func(), retry bool, err error) {
+	noop := func() {}
+
+	if req.Body == nil || req.Body == http.NoBody {
+		return noop, true, nil
+	}
+
+	if t.PreventRetryWithBody || t.BodyBufferLimit < 0 {
+		return noop, false, nil
+	}
+
+	if t.BodyBufferLimit == 0 {
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return noop, true, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+		return noop, true, nil
+	}
+
+	// Read one byte past the limit: reading exactly BodyBufferLimit
+	// bytes can't tell a body that ends right at the limit apart from
+	// one that keeps going, since io.LimitReader caps out at the limit
+	// either way.
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, io.LimitReader(req.Body, t.BodyBufferLimit+1))
+	if err != nil {
+		req.Body.Close()
+		return noop, true, err
+	}
+
+	if n <= t.BodyBufferLimit {
+		// The whole body fit at or under the limit: keep it in memory,
+		// as with the default (BodyBufferLimit == 0) behavior.
+		req.Body.Close()
+		body := buf.Bytes()
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+		return noop, true, nil
+	}
+
+	// The body is larger than the limit: spill the buffered prefix and
+	// the remainder of the stream to a temp file, and replay attempts
+	// by re-opening it.
+	f, err := os.CreateTemp("", "rehttp-body-*")
+	if err != nil {
+		req.Body.Close()
+		return noop, true, err
+	}
+	cleanup = func() { os.Remove(f.Name()) }
+
+	_, werr := io.Copy(f, io.MultiReader(bytes.NewReader(buf.Bytes()), req.Body))
+	req.Body.Close()
+	if cerr := f.Close(); werr == nil {
+		werr = cerr
+	}
+	if werr != nil {
+		cleanup()
+		return noop, true, werr
+	}
+
+	name := f.Name()
+	req.GetBody = func() (io.ReadCloser, error) {
+		return os.Open(name)
+	}
+	if req.Body, err = req.GetBody(); err != nil {
+		cleanup()
+		return noop, true, err
+	}
+
+	return cleanup, true, nil
+}
+
+// RoundTrip implements http.RoundTripper. It executes the request,
+// retrying it as determined by the Transport's retryFn and delayFn,
+// until it succeeds, is no longer retried, or fails to be re-sent (e.g.
+// because of a body that cannot be replayed).
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	cleanup, retry, err := t.prepareBody(req)
+	defer cleanup()
+	if err != nil {
+		return nil, err
+	}
+	if !retry {
+		return t.rt.RoundTrip(req)
+	}
+
+	ctx := context.WithValue(req.Context(), retryBudgetWindowCtxKey{}, t.budgetWindowOrInit())
+	req = req.WithContext(ctx)
+
+	for attempt := 0; ; attempt++ {
+		if req.Body != nil && req.Body != http.NoBody && attempt > 0 {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+
+		res, err := t.rt.RoundTrip(req)
+		if !t.retryFn(req, res, attempt, err) {
+			if attempt > 0 && isFailure(res, err) && t.Trace != nil && t.Trace.GaveUp != nil {
+				t.Trace.GaveUp(req, res, attempt+1, err)
+			}
+			return res, err
+		}
+
+		if res != nil && res.Body != nil {
+			io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+		}
+
+		delay := t.delayFn(req, res, attempt, err)
+		if t.Trace != nil && t.Trace.WillRetry != nil {
+			t.Trace.WillRetry(req, res, attempt, err, delay)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			ctxErr := req.Context().Err()
+			if isFailure(res, ctxErr) && t.Trace != nil && t.Trace.GaveUp != nil {
+				t.Trace.GaveUp(req, res, attempt+1, ctxErr)
+			}
+			return nil, ctxErr
+		}
+	}
+}
+
+// NoDelay returns a DelayFn that always returns a delay of 0.
+func NoDelay() DelayFn {
+	return func(_ *http.Request, _ *http.Response, _ int, _ error) time.Duration {
+		return 0
+	}
+}
+
+// ConstDelay returns a DelayFn that always returns the same delay, d.
+func ConstDelay(d time.Duration) DelayFn {
+	return func(_ *http.Request, _ *http.Response, _ int, _ error) time.Duration {
+		return d
+	}
+}
+
+// LinearDelay returns a DelayFn that returns a delay that increases
+// linearly with the attempt number, starting at initial for the first
+// attempt.
+func LinearDelay(initial time.Duration) DelayFn {
+	return func(_ *http.Request, _ *http.Response, attempt int, _ error) time.Duration {
+		return initial * time.Duration(attempt+1)
+	}
+}
+
+// ExponentialDelay returns a DelayFn that returns a delay that grows
+// exponentially between attempts, starting at initial for the first
+// attempt and growing by a factor of initial/max at each subsequent
+// attempt.
+func ExponentialDelay(initial, max time.Duration) DelayFn {
+	return func(_ *http.Request, _ *http.Response, attempt int, _ error) time.Duration {
+		exp := math.Pow(float64(initial)/float64(max), float64(attempt))
+		top := float64(initial) * exp
+		if top >= float64(math.MaxInt64) {
+			return time.Duration(math.MaxInt64)
+		}
+		return time.Duration(top)
+	}
+}
+
+// jitterRandMu and jitterRandSrc back ExponentialJitterDelay and
+// EqualJitterDelay when called with a nil *rand.Rand, so that a single
+// DelayFn can be shared safely across goroutines.
+var (
+	jitterRandMu  sync.Mutex
+	jitterRandSrc = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// jitterRandInt63n returns a random int64 in [0, n) using rng, or the
+// package-level, mutex-protected source if rng is nil.
+func jitterRandInt63n(rng *rand.Rand, n int64) int64 {
+	if rng != nil {
+		return rng.Int63n(n)
+	}
+	jitterRandMu.Lock()
+	defer jitterRandMu.Unlock()
+	return jitterRandSrc.Int63n(n)
+}
+
+// expCap returns min(cap, base*2^attempt), computed with integer
+// doubling so it saturates at cap instead of overflowing time.Duration
+// for large attempt counts.
+func expCap(base, cap time.Duration, attempt int) time.Duration {
+	if attempt < 0 {
+		attempt = 0
+	}
+	v := base
+	for i := 0; i < attempt && v < cap; i++ {
+		if v > cap/2 {
+			return cap
+		}
+		v *= 2
+	}
+	if v > cap {
+		return cap
+	}
+	return v
+}
+
+// ExponentialJitterDelay returns a DelayFn implementing the "full
+// jitter" exponential backoff strategy popularized by AWS: on attempt
+// i, it computes v = min(cap, base*2^i) and returns a uniformly random
+// duration in [0, v). If rng is nil, a shared, mutex-protected source is
+// used instead, making the returned DelayFn safe to use concurrently.
+func ExponentialJitterDelay(base, cap time.Duration, rng *rand.Rand) DelayFn {
+	return func(_ *http.Request, _ *http.Response, attempt int, _ error) time.Duration {
+		v := expCap(base, cap, attempt)
+		if v <= 0 {
+			return 0
+		}
+		return time.Duration(jitterRandInt63n(rng, int64(v)))
+	}
+}
+
+// EqualJitterDelay returns a DelayFn implementing the "equal jitter"
+// exponential backoff strategy: on attempt i, it computes
+// v = min(cap, base*2^i) and returns v/2 plus a uniformly random
+// duration in [0, v/2). Like ExponentialJitterDelay, a nil rng falls
+// back to a shared, mutex-protected source.
+func EqualJitterDelay(base, cap time.Duration, rng *rand.Rand) DelayFn {
+	return func(_ *http.Request, _ *http.Response, attempt int, _ error) time.Duration {
+		v := expCap(base, cap, attempt)
+		half := v / 2
+		if half <= 0 {
+			return half
+		}
+		return half + time.Duration(jitterRandInt63n(rng, int64(half)))
+	}
+}
+
+// RetryAfterDelay returns a DelayFn that honors the Retry-After header of
+// a response, as defined by RFC 7231 section 7.1.3. The header value may
+// be either an integer number of seconds to wait, or an HTTP-date after
+// which to retry. A negative number of seconds or a date that has
+// already passed yields a delay of 0. If the header is absent or
+// malformed, fallback is called instead.
+func RetryAfterDelay(fallback DelayFn) DelayFn {
+	return func(req *http.Request, res *http.Response, attempt int, err error) time.Duration {
+		if res != nil {
+			if v := res.Header.Get("Retry-After"); v != "" {
+				if secs, serr := strconv.Atoi(v); serr == nil {
+					if secs < 0 {
+						return 0
+					}
+					return time.Duration(secs) * time.Second
+				}
+				if t, terr := http.ParseTime(v); terr == nil {
+					if d := time.Until(t); d > 0 {
+						return d
+					}
+					return 0
+				}
+			}
+		}
+		return fallback(req, res, attempt, err)
+	}
+}
+
+// RetryHTTPMethods returns a RetryFn that retries requests whose method
+// is one of meths (case-insensitive), up to retries attempts.
+func RetryHTTPMethods(retries int, meths ...string) RetryFn {
+	return func(req *http.Request, _ *http.Response, attempt int, _ error) bool {
+		if attempt >= retries {
+			return false
+		}
+		for _, m := range meths {
+			if strings.EqualFold(m, req.Method) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// RetryStatus500 returns a RetryFn that retries requests that received
+// a response with a status code of 500 or greater, up to retries
+// attempts.
+func RetryStatus500(retries int) RetryFn {
+	return func(_ *http.Request, res *http.Response, attempt int, _ error) bool {
+		if attempt >= retries {
+			return false
+		}
+		return res != nil && res.StatusCode >= 500
+	}
+}
+
+// temporary is the interface implemented by errors that expose whether
+// they are temporary, as defined by the net package.
+type temporary interface {
+	Temporary() bool
+}
+
+// RetryTemporaryErr returns a RetryFn that retries requests that failed
+// with a temporary error, up to retries attempts.
+func RetryTemporaryErr(retries int) RetryFn {
+	return func(_ *http.Request, _ *http.Response, attempt int, err error) bool {
+		if attempt >= retries {
+			return false
+		}
+		te, ok := err.(temporary)
+		return ok && te.Temporary()
+	}
+}
+
+// RetryAll returns a RetryFn that retries a request only if all of the
+// given RetryFns return true. An empty RetryAll always returns true.
+func RetryAll(fns ...RetryFn) RetryFn {
+	return func(req *http.Request, res *http.Response, attempt int, err error) bool {
+		for _, fn := range fns {
+			if !fn(req, res, attempt, err) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// RetryAny returns a RetryFn that retries a request if any of the given
+// RetryFns return true. An empty RetryAny always returns false.
+func RetryAny(fns ...RetryFn) RetryFn {
+	return func(req *http.Request, res *http.Response, attempt int, err error) bool {
+		for _, fn := range fns {
+			if fn(req, res, attempt, err) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// retryBudgetWindowCtxKey is the context key under which Transport
+// stashes its retry budget window, so that a RetryBudget RetryFn used
+// as a Transport's retryFn can share accounting with
+// Transport.RetryBudgetStats.
+type retryBudgetWindowCtxKey struct{}
+
+// retryBudgetBuckets is the number of 1 second buckets kept in a
+// retryBudgetWindow's ring, i.e. the width of its sliding window.
+const retryBudgetBuckets = 30
+
+// retryBudgetBucket accumulates requests and retries seen during one
+// second of wall clock time.
+type retryBudgetBucket struct {
+	second   int64
+	requests int
+	retries  int
+}
+
+// retryBudgetWindow is a lock-protected ring of per-second buckets used
+// to track a sliding window of requests and retries in O(1) per
+// decision.
+type retryBudgetWindow struct {
+	mu      sync.Mutex
+	buckets [retryBudgetBuckets]retryBudgetBucket
+}
+
+// bucket returns the bucket for second, resetting it first if it was
+// last used for a different, and thus stale, second.
+func (w *retryBudgetWindow) bucket(second int64) *retryBudgetBucket {
+	b := &w.buckets[second%retryBudgetBuckets]
+	if b.second != second {
+		*b = retryBudgetBucket{second: second}
+	}
+	return b
+}
+
+// totals sums the requests and retries recorded in the buckets that
+// fall within the trailing retryBudgetBuckets seconds ending at second.
+func (w *retryBudgetWindow) totals(second int64) (retries, requests int) {
+	oldest := second - retryBudgetBuckets + 1
+	for i := range w.buckets {
+		b := &w.buckets[i]
+		if b.second >= oldest && b.second <= second {
+			retries += b.retries
+			requests += b.requests
+		}
+	}
+	return retries, requests
+}
+
+// recordRequest accounts for one more request in the current second's
+// bucket, and returns the retries/requests totals over the window as it
+// stood right before this request.
+func (w *retryBudgetWindow) recordRequest() (retries, requests int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now().Unix()
+	retries, requests = w.totals(now)
+	w.bucket(now).requests++
+	return retries, requests
+}
+
+// recordRetry accounts for one more retry in the current second's
+// bucket.
+func (w *retryBudgetWindow) recordRetry() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.bucket(time.Now().Unix()).retries++
+}
+
+// stats returns the current retries/requests totals over the window.
+func (w *retryBudgetWindow) stats() (retries, requests int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.totals(time.Now().Unix())
+}
+
+// RetryBudget returns a RetryFn that wraps inner with a retry budget: it
+// tracks a sliding 30 second window of requests and retries, and
+// refuses to retry -- even when inner says to -- once the ratio of
+// retries to requests in that window exceeds ratio. This guards against
+// retry amplification: under a partial outage, naive retrying can
+// multiply load on an already struggling backend. The budget only
+// kicks in once at least minRequests requests have been seen in the
+// window, so it doesn't misfire on bursts of low traffic.
+//
+// When the returned RetryFn is used as a Transport's retryFn, its live
+// utilization can be read back through Transport.RetryBudgetStats.
+// Otherwise, it falls back to a window private to this RetryFn.
+func RetryBudget(inner RetryFn, ratio float64, minRequests int) RetryFn {
+	fallback := &retryBudgetWindow{}
+
+	return func(req *http.Request, res *http.Response, attempt int, err error) bool {
+		w := fallback
+		if cw, ok := req.Context().Value(retryBudgetWindowCtxKey{}).(*retryBudgetWindow); ok {
+			w = cw
+		}
+
+		retries, requests := w.recordRequest()
+		if requests >= minRequests && requests > 0 && float64(retries)/float64(requests) > ratio {
+			return false
+		}
+
+		if !inner(req, res, attempt, err) {
+			return false
+		}
+		w.recordRetry()
+		return true
+	}
+}
+
+// ToRetryFn combines a RetryFn and a DelayFn into a single function
+// that returns both whether to retry and the delay to respect before
+// doing so.
+func ToRetryFn(retryFn RetryFn, delayFn DelayFn) func(*http.Request, *http.Response, int, error) (bool, time.Duration) {
+	return func(req *http.Request, res *http.Response, attempt int, err error) (bool, time.Duration) {
+		if !retryFn(req, res, attempt, err) {
+			return false, 0
+		}
+		return true, delayFn(req, res, attempt, err)
+	}
+}
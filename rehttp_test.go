@@ -2,14 +2,19 @@ package rehttp
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"math"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"testing/iotest"
 	"time"
@@ -175,6 +180,184 @@ func TestClientRetryWithBody(t *testing.T) {
 	assert.Equal(t, []string{"hello", "hello"}, mock.Bodies())
 }
 
+func TestClientCancelDuringDelay(t *testing.T) {
+	retFn := func(att int, req *http.Request) (*http.Response, error) {
+		return nil, tempErr{}
+	}
+	mock := &mockRoundTripper{t: t, retFn: retFn}
+
+	client := &http.Client{
+		Transport: NewTransport(mock, RetryTemporaryErr(1), ConstDelay(10*time.Second)),
+	}
+
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	require.Nil(t, err)
+	ctx, cancel := context.WithCancel(req.Context())
+	req = req.WithContext(ctx)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	_, err = client.Do(req)
+	elapsed := time.Since(start)
+
+	assert.Less(t, elapsed, 500*time.Millisecond)
+	if assert.NotNil(t, err) {
+		uerr, ok := err.(*url.Error)
+		require.True(t, ok)
+		assert.Equal(t, context.Canceled, uerr.Err)
+	}
+	assert.Equal(t, 1, mock.Calls())
+}
+
+func TestTransportTraceWillRetryAndGaveUp(t *testing.T) {
+	retFn := func(att int, req *http.Request) (*http.Response, error) {
+		return nil, tempErr{}
+	}
+	mock := &mockRoundTripper{t: t, retFn: retFn}
+
+	var mu sync.Mutex
+	var willRetryCalls int
+	var gaveUpReq *http.Request
+	var gaveUpAttempts int
+	var gaveUpErr error
+
+	tr := NewTransport(mock, RetryTemporaryErr(2), NoDelay())
+	tr.Trace = &RetryTrace{
+		WillRetry: func(req *http.Request, res *http.Response, attempt int, err error, delay time.Duration) {
+			mu.Lock()
+			defer mu.Unlock()
+			willRetryCalls++
+		},
+		GaveUp: func(req *http.Request, res *http.Response, attempts int, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			gaveUpReq = req
+			gaveUpAttempts = attempts
+			gaveUpErr = err
+		},
+	}
+
+	client := &http.Client{Transport: tr}
+	_, err := client.Get("http://example.com")
+	require.NotNil(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 3, mock.Calls())
+	assert.Equal(t, 2, willRetryCalls) // once per failed attempt that gets retried
+	assert.Equal(t, 3, gaveUpAttempts)
+	assert.Equal(t, tempErr{}, gaveUpErr)
+	assert.NotNil(t, gaveUpReq)
+}
+
+func TestTransportTraceNoGaveUpOnEventualSuccess(t *testing.T) {
+	retFn := func(att int, req *http.Request) (*http.Response, error) {
+		if att == 0 {
+			return nil, tempErr{}
+		}
+		return &http.Response{StatusCode: 200, Body: http.NoBody}, nil
+	}
+	mock := &mockRoundTripper{t: t, retFn: retFn}
+
+	var mu sync.Mutex
+	var gaveUpCalls int
+
+	tr := NewTransport(mock, RetryTemporaryErr(1), NoDelay())
+	tr.Trace = &RetryTrace{
+		GaveUp: func(req *http.Request, res *http.Response, attempts int, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			gaveUpCalls++
+		},
+	}
+
+	client := &http.Client{Transport: tr}
+	res, err := client.Get("http://example.com")
+	require.Nil(t, err)
+	require.Equal(t, 200, res.StatusCode)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 2, mock.Calls())
+	assert.Equal(t, 0, gaveUpCalls, "GaveUp must not fire when a retried request eventually succeeds")
+}
+
+func TestClientBodyBufferLimitSpillsToDisk(t *testing.T) {
+	const size = 11 << 20 // > 10MB
+	body := make([]byte, size)
+	for i := range body {
+		body[i] = byte(i)
+	}
+
+	retFn := func(att int, req *http.Request) (*http.Response, error) {
+		return nil, tempErr{}
+	}
+	mock := &mockRoundTripper{t: t, retFn: retFn}
+
+	tr := NewTransport(mock, RetryTemporaryErr(1), NoDelay())
+	tr.BodyBufferLimit = 1 << 20 // 1MB, well under the body size
+
+	client := &http.Client{Transport: tr}
+	_, err := client.Post("http://example.com", "application/octet-stream", bytes.NewReader(body))
+	require.NotNil(t, err)
+
+	assert.Equal(t, 2, mock.Calls())
+	bodies := mock.Bodies()
+	require.Len(t, bodies, 2)
+	assert.Equal(t, string(body), bodies[0])
+	assert.Equal(t, bodies[0], bodies[1])
+}
+
+func TestPrepareBodyExactlyAtLimitStaysInMemory(t *testing.T) {
+	const limit = 16
+	body := bytes.Repeat([]byte("x"), limit)
+
+	req, err := http.NewRequest("POST", "http://example.com", bytes.NewReader(body))
+	require.Nil(t, err)
+
+	tr := NewTransport(nil, RetryAll(), NoDelay())
+	tr.BodyBufferLimit = limit
+
+	before, err := os.ReadDir(os.TempDir())
+	require.Nil(t, err)
+
+	cleanup, retry, err := tr.prepareBody(req)
+	defer cleanup()
+	require.Nil(t, err)
+	require.True(t, retry)
+
+	after, err := os.ReadDir(os.TempDir())
+	require.Nil(t, err)
+	assert.Equal(t, len(before), len(after), "a body exactly at the limit must not spill to disk")
+
+	got, err := req.GetBody()
+	require.Nil(t, err)
+	gotBytes, err := io.ReadAll(got)
+	require.Nil(t, err)
+	assert.Equal(t, body, gotBytes)
+}
+
+func TestClientBodyBufferLimitNegativeDisablesRetry(t *testing.T) {
+	retFn := func(att int, req *http.Request) (*http.Response, error) {
+		return nil, tempErr{}
+	}
+	mock := &mockRoundTripper{t: t, retFn: retFn}
+
+	tr := NewTransport(mock, RetryTemporaryErr(1), NoDelay())
+	tr.BodyBufferLimit = -1
+
+	client := &http.Client{Transport: tr}
+	_, err := client.Post("http://example.com", "text/plain", strings.NewReader("test"))
+	require.NotNil(t, err)
+
+	assert.Equal(t, 1, mock.Calls())
+	assert.Equal(t, []string{"test"}, mock.Bodies())
+}
+
 func TestClientNoRetry(t *testing.T) {
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprint(w, r.URL.Path)
@@ -241,6 +424,90 @@ func TestExponentialDelay(t *testing.T) {
 	}
 }
 
+func TestExponentialDelayNoOverflow(t *testing.T) {
+	fn := ExponentialDelay(time.Second, time.Millisecond)
+	got := fn(nil, nil, 100, nil)
+	assert.Equal(t, time.Duration(math.MaxInt64), got)
+}
+
+func TestExponentialJitterDelay(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	fn := ExponentialJitterDelay(time.Second, 30*time.Second, rng)
+
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second} {
+		got := fn(nil, nil, i, nil)
+		assert.True(t, got >= 0 && got < want, "%d: got %s, want [0, %s)", i, got, want)
+	}
+
+	// attempts high enough to saturate at cap
+	got := fn(nil, nil, 10, nil)
+	assert.True(t, got >= 0 && got < 30*time.Second, "got %s", got)
+
+	// concurrent use of the shared package-level source must not race
+	var wg sync.WaitGroup
+	shared := ExponentialJitterDelay(time.Millisecond, time.Second, nil)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			shared(nil, nil, 3, nil)
+		}()
+	}
+	wg.Wait()
+}
+
+func TestEqualJitterDelay(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	fn := EqualJitterDelay(time.Second, 30*time.Second, rng)
+
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second} {
+		got := fn(nil, nil, i, nil)
+		assert.True(t, got >= want/2 && got < want, "%d: got %s, want [%s, %s)", i, got, want/2, want)
+	}
+
+	got := fn(nil, nil, 10, nil)
+	assert.True(t, got >= 15*time.Second && got < 30*time.Second, "got %s", got)
+}
+
+func TestRetryAfterDelay(t *testing.T) {
+	fallback := ConstDelay(3 * time.Second)
+	fn := RetryAfterDelay(fallback)
+
+	mkRes := func(v string) *http.Response {
+		res := &http.Response{Header: make(http.Header)}
+		if v != "" {
+			res.Header.Set("Retry-After", v)
+		}
+		return res
+	}
+
+	cases := []struct {
+		name string
+		res  *http.Response
+		want time.Duration
+	}{
+		{"no response", nil, 3 * time.Second},
+		{"no header", mkRes(""), 3 * time.Second},
+		{"delta-seconds", mkRes("120"), 120 * time.Second},
+		{"negative delta-seconds", mkRes("-1"), 0},
+		{"malformed", mkRes("not-a-value"), 3 * time.Second},
+		{"past http-date", mkRes(time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)), 0},
+	}
+
+	for _, tc := range cases {
+		got := fn(nil, tc.res, 0, nil)
+		assert.Equal(t, tc.want, got, tc.name)
+	}
+
+	// future http-date: assert it's close to the expected delay, since
+	// the header only has second resolution and time passes between
+	// formatting it and calling fn.
+	future := time.Now().Add(2 * time.Minute)
+	res := mkRes(future.UTC().Format(http.TimeFormat))
+	got := fn(nil, res, 0, nil)
+	assert.InDelta(t, 2*time.Minute, got, float64(2*time.Second))
+}
+
 func TestRetryHTTPMethods(t *testing.T) {
 	cases := []struct {
 		retries int
@@ -387,6 +654,69 @@ func TestRetryAny(t *testing.T) {
 	assert.False(t, got, "empty RetryAny")
 }
 
+func TestRetryBudget(t *testing.T) {
+	alwaysRetry := func(*http.Request, *http.Response, int, error) bool { return true }
+	fn := RetryBudget(alwaysRetry, 0.5, 10)
+
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	require.Nil(t, err)
+
+	var allowed, refused int32
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if fn(req, nil, 0, tempErr{}) {
+				atomic.AddInt32(&allowed, 1)
+			} else {
+				atomic.AddInt32(&refused, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.True(t, refused > 0, "budget should have refused some retries once exhausted")
+	assert.True(t, allowed > 0, "budget should have allowed some retries before being exhausted")
+}
+
+func TestRetryBudgetWindowSlidingRecovery(t *testing.T) {
+	w := &retryBudgetWindow{}
+
+	// A burst of all-retries, as might happen during an outage.
+	b := w.bucket(1_000_000)
+	b.requests, b.retries = 10, 10
+
+	retries, requests := w.totals(1_000_000)
+	assert.Equal(t, 10, retries)
+	assert.Equal(t, 10, requests)
+
+	// After retryBudgetBuckets seconds, that burst has fully aged out of
+	// the trailing window, so the budget recovers.
+	retries, requests = w.totals(1_000_000 + retryBudgetBuckets)
+	assert.Equal(t, 0, retries)
+	assert.Equal(t, 0, requests)
+}
+
+func TestTransportRetryBudgetStats(t *testing.T) {
+	retFn := func(att int, req *http.Request) (*http.Response, error) {
+		return nil, tempErr{}
+	}
+	mock := &mockRoundTripper{t: t, retFn: retFn}
+
+	budget := RetryBudget(RetryTemporaryErr(5), 1, 0)
+	tr := NewTransport(mock, budget, NoDelay())
+	client := &http.Client{Transport: tr}
+
+	_, err := client.Get("http://example.com")
+	require.NotNil(t, err)
+
+	retries, requests := tr.RetryBudgetStats()
+	assert.True(t, requests > 0)
+	assert.True(t, retries > 0)
+	assert.True(t, retries < requests)
+}
+
 func TestToRetryFn(t *testing.T) {
 	fn := ToRetryFn(RetryTemporaryErr(2), LinearDelay(time.Second))
 